@@ -5,23 +5,75 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
-	"net/http"
-	"net/url"
 	"os"
 	"path"
-	"path/filepath"
-	"strings"
-	"sync"
 	"time"
 
 	"github.com/spf13/viper"
 
 	docker "github.com/fsouza/go-dockerclient"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/jonathanbp/golem-herder/metering"
 )
 
+// Resources describes the resource limits to apply to a container's HostConfig.
+// Zero values mean "use the viper default for this field", see ResourcesWithDefaults.
+type Resources struct {
+	Memory         int64
+	MemorySwap     int64
+	CPUShares      int64
+	CPUQuota       int64
+	CPUPeriod      int64
+	PidsLimit      int64
+	OomKillDisable bool
+}
+
+// ResourcesWithDefaults fills in any zero-valued field of the given Resources
+// (nil is treated as an empty Resources) from viper config, under the
+// "resources.*" keys named after the fields: "resources.memory",
+// "resources.memory_swap", "resources.cpu_shares", "resources.cpu_quota",
+// "resources.cpu_period", "resources.pids_limit" and
+// "resources.oom_kill_disable". There is no combined "resources.cpus" key;
+// CPU limits come only from the three cpu_* keys.
+func ResourcesWithDefaults(r *Resources) *Resources {
+	defaults := Resources{
+		Memory:         viper.GetInt64("resources.memory"),
+		MemorySwap:     viper.GetInt64("resources.memory_swap"),
+		CPUShares:      viper.GetInt64("resources.cpu_shares"),
+		CPUQuota:       viper.GetInt64("resources.cpu_quota"),
+		CPUPeriod:      viper.GetInt64("resources.cpu_period"),
+		PidsLimit:      viper.GetInt64("resources.pids_limit"),
+		OomKillDisable: viper.GetBool("resources.oom_kill_disable"),
+	}
+	if r == nil {
+		return &defaults
+	}
+	if r.Memory == 0 {
+		r.Memory = defaults.Memory
+	}
+	if r.MemorySwap == 0 {
+		r.MemorySwap = defaults.MemorySwap
+	}
+	if r.CPUShares == 0 {
+		r.CPUShares = defaults.CPUShares
+	}
+	if r.CPUQuota == 0 {
+		r.CPUQuota = defaults.CPUQuota
+	}
+	if r.CPUPeriod == 0 {
+		r.CPUPeriod = defaults.CPUPeriod
+	}
+	if r.PidsLimit == 0 {
+		r.PidsLimit = defaults.PidsLimit
+	}
+	if !r.OomKillDisable {
+		r.OomKillDisable = defaults.OomKillDisable
+	}
+	return r
+}
+
 // GetAvailableHostPort returns an available (and random) port on the host machine
 func GetAvailableHostPort() int {
 	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
@@ -38,19 +90,24 @@ func GetAvailableHostPort() int {
 }
 
 // List containers matching the given predicate.
+//
+// Deprecated: this package-level wrapper uses client when it is non-nil and
+// otherwise a lazily-constructed default Engine, for backwards compatibility;
+// prefer constructing an *Engine with NewEngine and calling (*Engine).List.
 func List(client *docker.Client, matches func(container *docker.APIContainers) bool, all bool) ([]docker.APIContainers, error) {
-
-	// Create client if it is not given
-	if client == nil {
-		c, err := docker.NewClientFromEnv()
-		if err != nil {
-			log.WithError(err).Error("Could not create docker client")
-			return nil, err
-		}
-		client = c
+	if client != nil {
+		return (&Engine{client: client}).List(matches, all)
 	}
+	e, err := defaultEngine()
+	if err != nil {
+		return nil, err
+	}
+	return e.List(matches, all)
+}
 
-	containers, err := client.ListContainers(docker.ListContainersOptions{All: all})
+// List containers matching the given predicate.
+func (e *Engine) List(matches func(container *docker.APIContainers) bool, all bool) ([]docker.APIContainers, error) {
+	containers, err := e.client.ListContainers(docker.ListContainersOptions{All: all})
 	if err != nil {
 		log.WithError(err).Error("Error listing containers")
 		return nil, err
@@ -116,79 +173,36 @@ func WithState(state string) func(container *docker.APIContainers) bool {
 	}
 }
 
-// LoadFiles will load the given files into the dir for container usage
-func LoadFiles(dir string, files map[string][]byte) error {
-
-	var wg sync.WaitGroup
-
-	// write stuff to tmp dir
-	for name, content := range files {
-		// check if content is something we need to fetch
-		if url, err := url.Parse(string(content)); err == nil && strings.HasPrefix(string(content), "http") {
-			wg.Add(1)
-			go func(name string) {
-				defer wg.Done()
-				request, err := http.NewRequest("GET", url.String(), nil)
-				if err != nil {
-					log.WithError(err).WithField("url", url.String()).Warn("Could not create request")
-				}
-				// we need to add basic auth for webstrates assets
-				if url.Hostname() == "webstrates.cs.au.dk" || url.Hostname() == "hiraku.cs.au.dk" {
-					request.SetBasicAuth("web", "strate")
-				}
-				response, err := http.DefaultClient.Do(request)
-				if err != nil {
-					log.WithError(err).WithField("file", name).WithField("url", url.String()).Warn("Could not GET content to store in container")
-				}
-				defer response.Body.Close()
-				fetchedContent, err := ioutil.ReadAll(response.Body)
-				if err != nil {
-					log.WithError(err).WithField("url", url.String()).Warn("Error getting body")
-				}
-				// write content of url to file
-				log.WithField("file", name).Info("Writing fetched content to tmp dir")
-				err = ioutil.WriteFile(filepath.Join(dir, name), fetchedContent, 0644)
-				if err != nil {
-					log.WithError(err).WithField("file", name).Warn("Could not write file to tmp dir")
-				}
-			}(name)
-		} else {
-			// default case, something not an url
-			log.WithField("file", name).Info("Writing provided content to tmp dir")
-			err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644)
-			if err != nil {
-				log.WithError(err).WithField("file", name).Warn("Could not write file to tmp dir")
-				return err
-			}
-		}
-	}
-
-	// Wait for all async tasks to complete
-	wg.Wait()
-	return nil
-}
-
-// Kill the container with the given name and optionally remove mounted volumes.
-func Kill(matcher func(container *docker.APIContainers) bool, removeContainer, destroyData bool) error {
-
-	client, err := docker.NewClientFromEnv()
+// Kill the container matching filter and optionally remove mounted volumes.
+//
+// Deprecated: this package-level wrapper uses a lazily-constructed default
+// Engine for backwards compatibility; prefer constructing an *Engine with
+// NewEngine and calling (*Engine).Kill.
+func Kill(filter *Filter, removeContainer, destroyData bool) error {
+	e, err := defaultEngine()
 	if err != nil {
-		log.WithError(err).Error("Could not create docker client")
 		return err
 	}
+	return e.Kill(filter, removeContainer, destroyData)
+}
 
-	containers, err := List(client, matcher, false)
+// Kill the container matching filter and optionally remove mounted volumes.
+// filter is resolved through ListFiltered, so it can identify the container
+// by herder.kind/herder.owner/herder.name labels or ID instead of requiring
+// callers to match on container names.
+func (e *Engine) Kill(filter *Filter, removeContainer, destroyData bool) error {
+	containers, err := e.ListFiltered(filter, false)
 	if err != nil {
 		log.WithError(err).Warn("Error listing containers")
 		return err
 	}
 	if len(containers) != 1 {
 		log.WithField("count", len(containers)).Warn("Too many or too few matching containers")
-		return fmt.Errorf("Expected 1 container to match name, got %v", len(containers))
+		return fmt.Errorf("Expected 1 container to match filter, got %v", len(containers))
 	}
 
 	log.WithField("container", containers[0].ID).Info("Killing container")
-	err = client.KillContainer(docker.KillContainerOptions{ID: containers[0].ID})
+	err = e.client.KillContainer(docker.KillContainerOptions{ID: containers[0].ID})
 	if err != nil {
 		return err
 	}
@@ -196,7 +210,7 @@ func Kill(matcher func(container *docker.APIContainers) bool, removeContainer, d
 	if removeContainer {
 
 		log.WithField("container", containers[0].ID).Info("Removing container")
-		err = client.RemoveContainer(docker.RemoveContainerOptions{
+		err = e.client.RemoveContainer(docker.RemoveContainerOptions{
 			ID:            containers[0].ID,
 			Force:         true,
 			RemoveVolumes: destroyData,
@@ -210,7 +224,10 @@ func Kill(matcher func(container *docker.APIContainers) bool, removeContainer, d
 	return nil
 }
 
-func run(client *docker.Client, name, repository, tag string, ports map[int]int, mounts map[string]string, labels map[string]string, restart bool) (*docker.Container, error) {
+func (e *Engine) run(name, repository, tag string, ports map[int]int, mounts map[string]string, labels map[string]string, restart bool, resources *Resources, kind, owner string) (*docker.Container, error) {
+	client := e.client
+
+	labels = herderLabels(labels, kind, name, owner)
 
 	log.WithFields(log.Fields{"image": fmt.Sprintf("%s:%s", repository, tag)}).Info("Pulling image")
 
@@ -248,6 +265,8 @@ func run(client *docker.Client, name, repository, tag string, ports map[int]int,
 		}
 	}
 
+	resources = ResourcesWithDefaults(resources)
+
 	container, err := client.CreateContainer(
 		docker.CreateContainerOptions{
 			Name: name,
@@ -263,8 +282,15 @@ func run(client *docker.Client, name, repository, tag string, ports map[int]int,
 				Tty:          true,
 			},
 			HostConfig: &docker.HostConfig{
-				PortBindings: portBindings,
-				Binds:        binds,
+				PortBindings:   portBindings,
+				Binds:          binds,
+				Memory:         resources.Memory,
+				MemorySwap:     resources.MemorySwap,
+				CPUShares:      resources.CPUShares,
+				CPUQuota:       resources.CPUQuota,
+				CPUPeriod:      resources.CPUPeriod,
+				PidsLimit:      resources.PidsLimit,
+				OOMKillDisable: resources.OomKillDisable,
 			},
 		},
 	)
@@ -276,7 +302,7 @@ func run(client *docker.Client, name, repository, tag string, ports map[int]int,
 		}
 		// try finding container by name
 		log.WithField("name", name).Info("Looking for container")
-		containers, err := List(client, WithName(name), true)
+		containers, err := e.List(WithName(name), true)
 		if err != nil {
 			return nil, err
 		}
@@ -307,16 +333,90 @@ func run(client *docker.Client, name, repository, tag string, ports map[int]int,
 	return c, nil
 }
 
+// meterContainer samples the container's resource usage off Docker's stats
+// stream for as long as it runs, recording it against meter. It stops the
+// container as soon as meter reports the token is out of resources.
+func meterContainer(client *docker.Client, containerID string, meter *metering.Meter) {
+	if meter == nil {
+		return
+	}
+
+	statsC := make(chan *docker.Stats)
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Stats(docker.StatsOptions{ID: containerID, Stats: statsC, Stream: true})
+	}()
+
+	var lastSample time.Time
+	for stats := range statsC {
+		elapsed := stats.Read.Sub(lastSample)
+		if lastSample.IsZero() {
+			// No prior sample of our own to diff against yet - Docker
+			// reports PreRead alongside PreCPUStats for exactly this,
+			// so use that instead of dropping the first sample's usage.
+			elapsed = stats.Read.Sub(stats.PreRead)
+		}
+		lastSample = stats.Read
+		if elapsed <= 0 {
+			continue
+		}
+
+		usage := metering.ResourceUsage{
+			Milliseconds:      int(elapsed / time.Millisecond),
+			MemoryByteSeconds: int64(float64(stats.MemoryStats.Usage) * (float64(elapsed) / float64(time.Second))),
+			CPUNanoSeconds:    int64(stats.CPUStats.CPUUsage.TotalUsage - stats.PreCPUStats.CPUUsage.TotalUsage),
+		}
+		if err := meter.Record(usage); err != nil {
+			log.WithError(err).WithField("container", containerID).Warn("Token out of resources, stopping container")
+			if err := client.StopContainer(containerID, 10); err != nil {
+				log.WithError(err).WithField("container", containerID).Warn("Error stopping container")
+			}
+			return
+		}
+	}
+	if err := <-done; err != nil {
+		log.WithError(err).WithField("container", containerID).Warn("Error streaming container stats")
+	}
+}
+
 // RunDaemonized will pull, create and start the container piping stdout and stderr to the given channels.
 // This function is meant to run longlived, persistent processes.
 // A directory (/<name>) will be mounted in the container in which data which must be persisted between sessions can be kept.
-func RunDaemonized(name, repository, tag string, ports map[int]int, files map[string][]byte, labels map[string]string, restart bool, stdout, stderr chan<- []byte, done chan<- bool) (*docker.Container, error) {
-
-	client, err := docker.NewClientFromEnv()
+//
+// Deprecated: this package-level wrapper uses a lazily-constructed default
+// Engine for backwards compatibility; prefer constructing an *Engine with
+// NewEngine and calling (*Engine).RunDaemonized.
+func RunDaemonized(name, repository, tag string, ports map[int]int, files map[string][]byte, labels map[string]string, restart bool, resources *Resources, meter *metering.Meter, stdout, stderr chan<- []byte, done chan<- bool) (*docker.Container, error) {
+	e, err := defaultEngine()
 	if err != nil {
-		log.WithError(err).Error("Could not create docker client")
 		return nil, err
 	}
+	return e.RunDaemonized(name, repository, tag, ports, files, labels, restart, resources, meter, stdout, stderr, done)
+}
+
+// RunDaemonized will pull, create and start the container piping stdout and stderr to the given channels.
+// This function is meant to run longlived, persistent processes.
+// A directory (/<name>) will be mounted in the container in which data which must be persisted between sessions can be kept.
+func (e *Engine) RunDaemonized(name, repository, tag string, ports map[int]int, files map[string][]byte, labels map[string]string, restart bool, resources *Resources, meter *metering.Meter, stdout, stderr chan<- []byte, done chan<- bool) (*docker.Container, error) {
+	client := e.client
+
+	if meter != nil {
+		// Refuse to start at all once the token is out of resources -
+		// Reserve only throttles concurrent admission, it doesn't know
+		// whether the token has any runtime budget left to spend.
+		outOfResources, err := meter.OutOfResources()
+		if err != nil {
+			return nil, err
+		}
+		if outOfResources {
+			return nil, fmt.Errorf("token %s is out of resources", meter.ID)
+		}
+		// Reserve atomically before starting, so two concurrent requests on
+		// the same token can't both pass a balance check and double-spend it.
+		if err := meter.Reserve(context.Background(), 1); err != nil {
+			return nil, err
+		}
+	}
 
 	hostdir := path.Join(viper.GetString("mounts"), name)
 
@@ -335,11 +435,15 @@ func RunDaemonized(name, repository, tag string, ports map[int]int, files map[st
 		return nil, err
 	}
 
-	c, err := run(client, name, repository, tag, ports, mounts, labels, restart)
+	c, err := e.run(name, repository, tag, ports, mounts, labels, restart, resources, KindDaemon, ownerFromMeter(meter))
 	if err != nil {
 		return nil, err
 	}
 
+	if meter != nil {
+		go meterContainer(client, c.ID, meter)
+	}
+
 	// Setup monitor for service - if it does done should be notified
 	if done != nil {
 		go func() {
@@ -369,56 +473,64 @@ func RunDaemonized(name, repository, tag string, ports map[int]int, files map[st
 		return c, nil
 	}
 
-	// Use a pipe to run stdout and stderr to channels
-	stdoutr, stdoutw := io.Pipe()
-	stderrr, stderrw := io.Pipe()
-	client.Logs(docker.LogsOptions{
-		Stdout:       true,
-		Container:    c.ID,
-		OutputStream: stdoutw,
-		ErrorStream:  stderrw,
-	})
-
-	// stdout goes to channel
-	go func(r io.Reader, out chan<- []byte) {
-		data := make([]byte, 512)
-		_, err := r.Read(data)
-		out <- data
-		if err != nil {
-			// stop looking for stdout
-			return
+	// Follow stdout/stderr for the life of the container, forwarding every
+	// line rather than only the first chunk.
+	ls := NewLogStream(client, c.ID, &ChannelLogDriver{Stdout: stdout, Stderr: stderr})
+	go func() {
+		if err := ls.Follow(context.Background(), time.Time{}, "all"); err != nil {
+			log.WithError(err).WithField("container", c.ID).Warn("Error following container logs")
 		}
-	}(stdoutr, stdout)
-
-	// stderr goes to channel
-	go func(r io.Reader, out chan<- []byte) {
-		data := make([]byte, 512)
-		_, err := r.Read(data)
-		out <- data
-		if err != nil {
-			// stop looking for stderr
-			return
-		}
-	}(stderrr, stderr)
+	}()
 
 	return c, nil
 }
 
 // RunLambda will pull, create and start the container returning its stdout.
 // This function is meant to run a shortlived process.
-func RunLambda(ctx context.Context, name, repository, tag string, mounts map[string]string) ([]byte, []byte, error) {
-
-	client, err := docker.NewClientFromEnv()
+//
+// Deprecated: this package-level wrapper uses a lazily-constructed default
+// Engine for backwards compatibility; prefer constructing an *Engine with
+// NewEngine and calling (*Engine).RunLambda.
+func RunLambda(ctx context.Context, name, repository, tag string, mounts map[string]string, resources *Resources, meter *metering.Meter) ([]byte, []byte, error) {
+	e, err := defaultEngine()
 	if err != nil {
-		log.WithError(err).Error("Could not create docker client")
 		return nil, nil, err
 	}
+	return e.RunLambda(ctx, name, repository, tag, mounts, resources, meter)
+}
+
+// RunLambda will pull, create and start the container returning its stdout.
+// This function is meant to run a shortlived process.
+func (e *Engine) RunLambda(ctx context.Context, name, repository, tag string, mounts map[string]string, resources *Resources, meter *metering.Meter) ([]byte, []byte, error) {
+	client := e.client
+
+	if meter != nil {
+		// Refuse to start at all once the token is out of resources -
+		// Reserve only throttles concurrent admission, it doesn't know
+		// whether the token has any runtime budget left to spend.
+		outOfResources, err := meter.OutOfResources()
+		if err != nil {
+			return nil, nil, err
+		}
+		if outOfResources {
+			return nil, nil, fmt.Errorf("token %s is out of resources", meter.ID)
+		}
+		// Reserve atomically before starting, so two concurrent requests on
+		// the same token can't both pass a balance check and double-spend it.
+		if err := meter.Reserve(ctx, 1); err != nil {
+			return nil, nil, err
+		}
+	}
 
-	container, err := run(client, name, repository, tag, nil, mounts, nil, false)
+	container, err := e.run(name, repository, tag, nil, mounts, nil, false, resources, KindLambda, ownerFromMeter(meter))
 	if err != nil {
 		return nil, nil, err
 	}
 
+	if meter != nil {
+		go meterContainer(client, container.ID, meter)
+	}
+
 	// Cleanup
 	defer func() {
 		err = client.RemoveContainer(docker.RemoveContainerOptions{
@@ -457,13 +569,21 @@ func RunLambda(ctx context.Context, name, repository, tag string, mounts map[str
 }
 
 // Attach to a container
+//
+// Deprecated: this package-level wrapper uses a lazily-constructed default
+// Engine for backwards compatibility; prefer constructing an *Engine with
+// NewEngine and calling (*Engine).Attach.
 func Attach(c docker.APIContainers, stdout, stderr chan<- []byte, stdin <-chan []byte) error {
-
-	client, err := docker.NewClientFromEnv()
+	e, err := defaultEngine()
 	if err != nil {
-		log.WithError(err).Error("Could not create docker client")
 		return err
 	}
+	return e.Attach(c, stdout, stderr, stdin)
+}
+
+// Attach to a container
+func (e *Engine) Attach(c docker.APIContainers, stdout, stderr chan<- []byte, stdin <-chan []byte) error {
+	client := e.client
 
 	// Use a pipe to run stdout and stderr to channels
 	stdoutr, stdoutw := io.Pipe()
@@ -486,44 +606,30 @@ func Attach(c docker.APIContainers, stdout, stderr chan<- []byte, stdin <-chan [
 		return err
 	}
 
-	// stdout goes to channel
-	go func(r io.Reader, out chan<- []byte, c io.Closer) {
-		for {
-			data := make([]byte, 512)
-			_, err := r.Read(data)
-			out <- data
-			if err != nil {
-				// stop looking for stdout
-				c.Close()
-				return
-			}
-		}
-	}(stdoutr, stdout, cw)
-
-	// stderr goes to channel
-	go func(r io.Reader, out chan<- []byte, c io.Closer) {
-		for {
-			data := make([]byte, 512)
-			_, err := r.Read(data)
-			out <- data
-			if err != nil {
-				// stop looking for stderr
-				c.Close()
-				return
-			}
-		}
-	}(stderrr, stderr, cw)
+	// stdout/stderr go to channel, via the same line-scanning forwarder
+	// RunDaemonized uses, instead of a single fixed-size r.Read per
+	// iteration (which discarded n and forwarded unread trailing bytes).
+	driver := &ChannelLogDriver{Stdout: stdout, Stderr: stderr}
+	go func(r io.Reader, c io.Closer) {
+		forwardLines("stdout", r, []LogDriver{driver})
+		c.Close()
+	}(stdoutr, cw)
+
+	go func(r io.Reader, c io.Closer) {
+		forwardLines("stderr", r, []LogDriver{driver})
+		c.Close()
+	}(stderrr, cw)
 
-	// stdin goes from channel
+	// stdin goes from channel - keep writing until the channel itself is
+	// closed rather than giving up on the first write error, so a transient
+	// write failure doesn't tear down the attachment early.
 	go func(w io.Writer, in <-chan []byte, c io.Closer) {
 		for line := range in {
-			_, err := w.Write(line)
-			if err != nil {
-				// stop looking for stdin
-				c.Close()
-				return
+			if _, err := w.Write(line); err != nil {
+				log.WithError(err).Warn("Error writing stdin to container")
 			}
 		}
+		c.Close()
 	}(stdinw, stdin, cw)
 	return nil
 }
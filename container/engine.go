@@ -0,0 +1,99 @@
+package container
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/spf13/viper"
+
+	docker "github.com/fsouza/go-dockerclient"
+	log "github.com/sirupsen/logrus"
+)
+
+// Engine holds a single, reusable connection to a Docker daemon, configured
+// once from viper rather than having every call re-read the environment and
+// dial a fresh client. This is what lets the herder talk to a remote or
+// TLS-protected Docker daemon (or a Docker-in-Docker sidecar) instead of
+// always assuming a local socket.
+//
+// Config is read from:
+//
+//	docker.host        - e.g. "tcp://1.2.3.4:2376", defaults to $DOCKER_HOST
+//	docker.tls_verify   - whether to dial with client TLS certs
+//	docker.cert_path    - directory containing cert.pem/key.pem/ca.pem
+//	docker.api_version  - pin a specific Docker API version, if set
+//
+// When docker.host is unset the client is built from the DOCKER_HOST,
+// DOCKER_TLS_VERIFY and DOCKER_CERT_PATH environment variables, and
+// docker.tls_verify and docker.cert_path are not read.
+type Engine struct {
+	client *docker.Client
+}
+
+// NewEngine dials the Docker daemon described by viper config and verifies
+// the connection with a Ping before returning.
+func NewEngine() (*Engine, error) {
+	client, err := newEngineClient()
+	if err != nil {
+		log.WithError(err).Error("Could not create docker client")
+		return nil, err
+	}
+
+	if err := client.Ping(); err != nil {
+		log.WithError(err).Error("Could not reach docker daemon")
+		return nil, err
+	}
+
+	return &Engine{client: client}, nil
+}
+
+func newEngineClient() (*docker.Client, error) {
+	host := viper.GetString("docker.host")
+	apiVersion := viper.GetString("docker.api_version")
+
+	if host == "" {
+		if apiVersion != "" {
+			return docker.NewVersionedClientFromEnv(apiVersion)
+		}
+		return docker.NewClientFromEnv()
+	}
+
+	if !viper.GetBool("docker.tls_verify") {
+		if apiVersion != "" {
+			return docker.NewVersionedClient(host, apiVersion)
+		}
+		return docker.NewClient(host)
+	}
+
+	certPath := viper.GetString("docker.cert_path")
+	cert := filepath.Join(certPath, "cert.pem")
+	key := filepath.Join(certPath, "key.pem")
+	ca := filepath.Join(certPath, "ca.pem")
+	if apiVersion != "" {
+		return docker.NewVersionedTLSClient(host, cert, key, ca, apiVersion)
+	}
+	return docker.NewTLSClient(host, cert, key, ca)
+}
+
+// Client returns the Engine's underlying *docker.Client, for callers that
+// need lower-level access than the Engine methods provide.
+func (e *Engine) Client() *docker.Client {
+	return e.client
+}
+
+var (
+	defaultEngineOnce sync.Once
+	defaultEngineInst *Engine
+	defaultEngineErr  error
+)
+
+// defaultEngine lazily builds the package-level Engine used by the
+// package-level wrapper functions (List, Kill, RunDaemonized, ...), kept for
+// backwards compatibility with callers that don't construct their own
+// Engine.
+func defaultEngine() (*Engine, error) {
+	defaultEngineOnce.Do(func() {
+		defaultEngineInst, defaultEngineErr = NewEngine()
+	})
+	return defaultEngineInst, defaultEngineErr
+}
@@ -0,0 +1,229 @@
+package container
+
+import (
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/jonathanbp/golem-herder/metering"
+)
+
+// Herder applies a small label namespace to every container it creates, so
+// ownership and purpose can be determined from the container itself instead
+// of string-matching its name:
+//
+//	herder.kind  - one of KindMinion, KindDaemon, KindLambda
+//	herder.owner - the token (see metering.Meter.ID) the container was
+//	               created on behalf of, if any
+//	herder.name  - the logical name passed to RunDaemonized/RunLambda
+//
+// These are applied automatically by run() and can be queried cheaply with
+// Filter, which pushes label/name/status/id lookups down to the Docker
+// daemon's own filtering instead of listing every container and checking it
+// in process.
+const (
+	LabelKind  = "herder.kind"
+	LabelOwner = "herder.owner"
+	LabelName  = "herder.name"
+)
+
+// Container kinds used as the value of LabelKind.
+const (
+	KindMinion = "minion"
+	KindDaemon = "daemon"
+	KindLambda = "lambda"
+)
+
+// herderLabels returns labels merged with the herder.* namespace for a
+// container of the given kind/name/owner. owner may be empty.
+func herderLabels(labels map[string]string, kind, name, owner string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	merged[LabelKind] = kind
+	merged[LabelName] = name
+	if owner != "" {
+		merged[LabelOwner] = owner
+	}
+	return merged
+}
+
+// Filter builds a container query. Label/name/status/id predicates are
+// compiled down to Docker's native filters argument, which the daemon
+// evaluates itself; Custom predicates are evaluated in process against the
+// (already server-side-narrowed) result set, for composite or negated
+// queries the Docker API can't express directly.
+type Filter struct {
+	ids      []string
+	names    []string
+	labels   []string
+	statuses []string
+	custom   []func(container *docker.APIContainers) bool
+}
+
+// NewFilter returns an empty Filter.
+func NewFilter() *Filter {
+	return &Filter{}
+}
+
+// ID restricts the query to containers with the given ID.
+func (f *Filter) ID(id string) *Filter {
+	f.ids = append(f.ids, id)
+	return f
+}
+
+// Name restricts the query to containers with the given name.
+func (f *Filter) Name(name string) *Filter {
+	f.names = append(f.names, name)
+	return f
+}
+
+// Label restricts the query to containers carrying label=value.
+func (f *Filter) Label(label, value string) *Filter {
+	f.labels = append(f.labels, label+"="+value)
+	return f
+}
+
+// Kind restricts the query to containers of the given herder.kind.
+func (f *Filter) Kind(kind string) *Filter {
+	return f.Label(LabelKind, kind)
+}
+
+// Owner restricts the query to containers owned by the given token.
+func (f *Filter) Owner(owner string) *Filter {
+	return f.Label(LabelOwner, owner)
+}
+
+// Status restricts the query to containers in the given state (e.g. "running").
+func (f *Filter) Status(status string) *Filter {
+	f.statuses = append(f.statuses, status)
+	return f
+}
+
+// Custom adds an in-process predicate for composite or negated queries that
+// Docker's filters argument can't express on its own (e.g. Or/Not).
+func (f *Filter) Custom(matches func(container *docker.APIContainers) bool) *Filter {
+	f.custom = append(f.custom, matches)
+	return f
+}
+
+// dockerFilters compiles the native-filterable predicates to the map shape
+// ListContainersOptions.Filters expects.
+func (f *Filter) dockerFilters() map[string][]string {
+	filters := map[string][]string{}
+	if len(f.ids) > 0 {
+		filters["id"] = f.ids
+	}
+	if len(f.names) > 0 {
+		filters["name"] = f.names
+	}
+	if len(f.labels) > 0 {
+		filters["label"] = f.labels
+	}
+	if len(f.statuses) > 0 {
+		filters["status"] = f.statuses
+	}
+	return filters
+}
+
+// matchesCustom reports whether a container satisfies every Custom predicate.
+func (f *Filter) matchesCustom(container *docker.APIContainers) bool {
+	for _, matches := range f.custom {
+		if !matches(container) {
+			return false
+		}
+	}
+	return true
+}
+
+// ListFiltered lists containers matching filter, pushing id/name/label/status
+// predicates down to the Docker daemon via ListContainersOptions.Filters and
+// only falling back to in-process filtering for filter.Custom predicates.
+//
+// Deprecated: this package-level wrapper uses client when it is non-nil and
+// otherwise a lazily-constructed default Engine, for backwards compatibility;
+// prefer constructing an *Engine with NewEngine and calling
+// (*Engine).ListFiltered.
+func ListFiltered(client *docker.Client, filter *Filter, all bool) ([]docker.APIContainers, error) {
+	if client != nil {
+		return (&Engine{client: client}).ListFiltered(filter, all)
+	}
+	e, err := defaultEngine()
+	if err != nil {
+		return nil, err
+	}
+	return e.ListFiltered(filter, all)
+}
+
+// ListFiltered lists containers matching filter, pushing id/name/label/status
+// predicates down to the Docker daemon via ListContainersOptions.Filters and
+// only falling back to in-process filtering for filter.Custom predicates.
+func (e *Engine) ListFiltered(filter *Filter, all bool) ([]docker.APIContainers, error) {
+	containers, err := e.client.ListContainers(docker.ListContainersOptions{
+		All:     all,
+		Filters: filter.dockerFilters(),
+	})
+	if err != nil {
+		log.WithError(err).Error("Error listing containers")
+		return nil, err
+	}
+
+	if len(filter.custom) == 0 {
+		return containers, nil
+	}
+
+	matching := []docker.APIContainers{}
+	for _, c := range containers {
+		if filter.matchesCustom(&c) {
+			matching = append(matching, c)
+		}
+	}
+	return matching, nil
+}
+
+// FindLegacyContainers finds containers that predate the herder.* label
+// namespace (i.e. have no herder.kind label) and logs them as needing
+// attention. Docker does not support mutating labels on an existing
+// container, so this is detect-only: it does not relabel or recreate
+// anything. Callers that want these containers to become discoverable
+// through Filter-based label lookups must recreate them themselves (e.g. via
+// RunDaemonized, using the original container's config); this is meant to be
+// run once at startup to find stragglers left over from before this label
+// namespace existed.
+func FindLegacyContainers(client *docker.Client) ([]docker.APIContainers, error) {
+	legacy, err := List(client, func(c *docker.APIContainers) bool {
+		_, labeled := c.Labels[LabelKind]
+		return !labeled
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range legacy {
+		name := strings.TrimPrefix(firstName(c.Names), "/")
+		log.WithFields(log.Fields{
+			"container": c.ID,
+			"name":      name,
+		}).Warn("Container predates herder label namespace, recreate it to be discoverable via Filter")
+	}
+	return legacy, nil
+}
+
+// ownerFromMeter returns the token LabelOwner should carry for a container
+// metered by m, or "" if it isn't metered.
+func ownerFromMeter(m *metering.Meter) string {
+	if m == nil {
+		return ""
+	}
+	return m.ID
+}
+
+// firstName returns the first name Docker reports for a container, or "".
+func firstName(names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
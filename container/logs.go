@@ -0,0 +1,279 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	log "github.com/sirupsen/logrus"
+)
+
+// LogDriver receives log lines forwarded off a container's stdout/stderr.
+// stream is either "stdout" or "stderr". Implementations must be safe for
+// concurrent use, since stdout and stderr are forwarded from separate
+// goroutines.
+type LogDriver interface {
+	Write(stream string, line []byte) error
+	Close() error
+}
+
+// LogStream follows a container's stdout/stderr and forwards every line to
+// one or more LogDrivers, replacing one-shot reads with a proper
+// bufio.Scanner loop so no output is dropped after the first chunk.
+type LogStream struct {
+	client      *docker.Client
+	containerID string
+	drivers     []LogDriver
+}
+
+// NewLogStream returns a LogStream for the given container, fanning output
+// out to the given drivers.
+func NewLogStream(client *docker.Client, containerID string, drivers ...LogDriver) *LogStream {
+	return &LogStream{client: client, containerID: containerID, drivers: drivers}
+}
+
+// Follow starts streaming the container's stdout/stderr to the configured
+// drivers, replaying `tail` previous lines (use "all" for everything) since
+// the given time. It returns once the underlying Docker log stream ends or
+// ctx is cancelled.
+func (ls *LogStream) Follow(ctx context.Context, since time.Time, tail string) error {
+	stdoutR, stdoutW := io.Pipe()
+	stderrR, stderrW := io.Pipe()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); ls.forward("stdout", stdoutR) }()
+	go func() { defer wg.Done(); ls.forward("stderr", stderrR) }()
+
+	err := ls.client.Logs(docker.LogsOptions{
+		Context:      ctx,
+		Container:    ls.containerID,
+		OutputStream: stdoutW,
+		ErrorStream:  stderrW,
+		Stdout:       true,
+		Stderr:       true,
+		Follow:       true,
+		Since:        since.Unix(),
+		Tail:         tail,
+	})
+	stdoutW.CloseWithError(err)
+	stderrW.CloseWithError(err)
+	wg.Wait()
+	return err
+}
+
+// forward scans r line by line, handing every line to each of ls.drivers.
+func (ls *LogStream) forward(stream string, r io.Reader) {
+	forwardLines(stream, r, ls.drivers)
+}
+
+// forwardLines scans r line by line, handing every line to each driver.
+// Unlike a single r.Read into a fixed buffer, this keeps reading until r is
+// closed so later output isn't silently dropped, and never forwards unread
+// trailing bytes from a short read. Shared by LogStream.forward and Attach,
+// which reads its own stdout/stderr pipes rather than going through Docker's
+// Logs endpoint.
+func forwardLines(stream string, r io.Reader, drivers []LogDriver) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := append([]byte(nil), scanner.Bytes()...)
+		for _, d := range drivers {
+			if err := d.Write(stream, line); err != nil {
+				log.WithError(err).WithField("stream", stream).Warn("Error writing to log driver")
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.WithError(err).WithField("stream", stream).Warn("Error scanning container output")
+	}
+}
+
+// TailLogs replays the last n lines of output logged since the given time,
+// without attaching or following, so HTTP handlers can serve recent output
+// without holding a live connection open.
+//
+// Deprecated: this package-level wrapper uses a lazily-constructed default
+// Engine for backwards compatibility; prefer constructing an *Engine with
+// NewEngine and calling (*Engine).TailLogs.
+func TailLogs(containerID string, n int, since time.Time) ([]byte, error) {
+	e, err := defaultEngine()
+	if err != nil {
+		return nil, err
+	}
+	return e.TailLogs(containerID, n, since)
+}
+
+// TailLogs replays the last n lines of output logged since the given time,
+// without attaching or following, so HTTP handlers can serve recent output
+// without holding a live connection open.
+func (e *Engine) TailLogs(containerID string, n int, since time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	err := e.client.Logs(docker.LogsOptions{
+		Container:    containerID,
+		OutputStream: &buf,
+		ErrorStream:  &buf,
+		Stdout:       true,
+		Stderr:       true,
+		Tail:         fmt.Sprintf("%d", n),
+		Since:        since.Unix(),
+	})
+	if err != nil {
+		log.WithError(err).WithField("container", containerID).Warn("Error tailing container logs")
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ChannelLogDriver forwards log lines onto plain byte channels, matching the
+// channels RunDaemonized and Attach have always exposed to their callers.
+type ChannelLogDriver struct {
+	Stdout chan<- []byte
+	Stderr chan<- []byte
+}
+
+// Write implements LogDriver.
+func (d *ChannelLogDriver) Write(stream string, line []byte) error {
+	switch stream {
+	case "stdout":
+		if d.Stdout != nil {
+			d.Stdout <- line
+		}
+	case "stderr":
+		if d.Stderr != nil {
+			d.Stderr <- line
+		}
+	}
+	return nil
+}
+
+// Close implements LogDriver.
+func (d *ChannelLogDriver) Close() error {
+	return nil
+}
+
+// jsonFileLogEntry is a single line of a JSONFileLogDriver's log file,
+// modelled after Docker's own json-file log driver format.
+type jsonFileLogEntry struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+// JSONFileLogDriver writes log lines as newline-delimited JSON, rotating the
+// file once it exceeds maxSizeBytes and keeping up to maxFiles rotated
+// generations (path.1, path.2, ...), the same scheme as Docker's built-in
+// json-file log driver.
+type JSONFileLogDriver struct {
+	path         string
+	maxSizeBytes int64
+	maxFiles     int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewJSONFileLogDriver opens (creating if necessary) a json-file log at path.
+func NewJSONFileLogDriver(path string, maxSizeBytes int64, maxFiles int) (*JSONFileLogDriver, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &JSONFileLogDriver{path: path, maxSizeBytes: maxSizeBytes, maxFiles: maxFiles, f: f, size: info.Size()}, nil
+}
+
+// Write implements LogDriver.
+func (d *JSONFileLogDriver) Write(stream string, line []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, err := json.Marshal(jsonFileLogEntry{Log: string(line), Stream: stream, Time: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	entry = append(entry, '\n')
+
+	if d.maxSizeBytes > 0 && d.size+int64(len(entry)) > d.maxSizeBytes {
+		if err := d.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := d.f.Write(entry)
+	d.size += int64(n)
+	return err
+}
+
+// rotate closes the current log file, shifts path.1..path.N-1 up by one
+// generation and opens a fresh path. Renaming path.(maxFiles-1) to
+// path.maxFiles overwrites whatever oldest generation was already there, so
+// nothing beyond maxFiles generations is ever kept.
+func (d *JSONFileLogDriver) rotate() error {
+	if err := d.f.Close(); err != nil {
+		return err
+	}
+	for i := d.maxFiles - 1; i >= 1; i-- {
+		oldPath := fmt.Sprintf("%s.%d", d.path, i)
+		newPath := fmt.Sprintf("%s.%d", d.path, i+1)
+		os.Rename(oldPath, newPath)
+	}
+	if err := os.Rename(d.path, d.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(d.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	d.f = f
+	d.size = 0
+	return nil
+}
+
+// Close implements LogDriver.
+func (d *JSONFileLogDriver) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.f.Close()
+}
+
+// SyslogLogDriver forwards log lines to the local syslog daemon, tagging
+// stderr lines at warning severity and stdout lines at info severity.
+type SyslogLogDriver struct {
+	w *syslog.Writer
+}
+
+// NewSyslogLogDriver dials the local syslog daemon, tagging entries with tag.
+func NewSyslogLogDriver(tag string) (*SyslogLogDriver, error) {
+	w, err := syslog.New(syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogLogDriver{w: w}, nil
+}
+
+// Write implements LogDriver.
+func (d *SyslogLogDriver) Write(stream string, line []byte) error {
+	if stream == "stderr" {
+		return d.w.Warning(string(line))
+	}
+	return d.w.Info(string(line))
+}
+
+// Close implements LogDriver.
+func (d *SyslogLogDriver) Close() error {
+	return d.w.Close()
+}
@@ -0,0 +1,67 @@
+package container
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestJSONFileLogDriverRotation exercises the rotation boundary: once more
+// than maxFiles generations have been written, only the newest maxFiles
+// should survive, and the oldest generation's content must not reappear.
+func TestJSONFileLogDriverRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "container.log")
+
+	const maxFiles = 2
+	d, err := NewJSONFileLogDriver(path, 1, maxFiles)
+	if err != nil {
+		t.Fatalf("NewJSONFileLogDriver: %v", err)
+	}
+
+	// maxSizeBytes of 1 means every Write rotates before writing, so each
+	// call produces a fresh generation.
+	for _, line := range []string{"first", "second", "third"} {
+		if err := d.Write("stdout", []byte(line)); err != nil {
+			t.Fatalf("Write(%q): %v", line, err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected %s.3 not to exist (maxFiles=%d), stat err: %v", path, maxFiles, err)
+	}
+
+	for i, generation := range []string{path, path + ".1", path + ".2"} {
+		if _, err := os.Stat(generation); err != nil {
+			t.Errorf("generation %d (%s) missing: %v", i, generation, err)
+		}
+	}
+
+	entries := readJSONFileLogEntries(t, path+".1")
+	if len(entries) != 1 || entries[0].Log != "second" {
+		t.Errorf("%s.1 = %v, want a single entry logging %q", path, entries, "second")
+	}
+}
+
+func readJSONFileLogEntries(t *testing.T, path string) []jsonFileLogEntry {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile(%s): %v", path, err)
+	}
+
+	var entries []jsonFileLogEntry
+	for _, line := range bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) {
+		var entry jsonFileLogEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatalf("Unmarshal(%s): %v", path, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
@@ -0,0 +1,389 @@
+package container
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Source fetches the bytes a spec refers to, for one registered scheme.
+type Source interface {
+	Fetch(ctx context.Context, spec string) ([]byte, error)
+}
+
+// SourceResolver resolves the content specs LoadFiles receives - URLs,
+// local paths, git refs or raw bytes - against a registry of Sources keyed
+// by scheme, replacing the old hardcoded "if it starts with http" fetcher.
+//
+// A spec may carry a "!sha256:<hex>" suffix, which is verified against the
+// fetched bytes before they're used; content failing the check is treated
+// as a fetch error. Specs that don't match any registered scheme are
+// treated as literal inline bytes, the same fallback LoadFiles has always
+// had, so existing callers keep working unchanged.
+type SourceResolver struct {
+	sources     map[string]Source
+	concurrency int
+}
+
+// NewSourceResolver returns a SourceResolver with the built-in schemes
+// registered: http(s)://, file://, s3://, git+https://...#ref/path and
+// inline:.
+func NewSourceResolver() *SourceResolver {
+	concurrency := viper.GetInt("sources.concurrency")
+	if concurrency <= 0 {
+		concurrency = 8
+	}
+
+	r := &SourceResolver{sources: map[string]Source{}, concurrency: concurrency}
+	httpSrc := &httpSource{}
+	r.Register("http", httpSrc)
+	r.Register("https", httpSrc)
+	r.Register("file", &fileSource{})
+	r.Register("s3", &s3Source{})
+	r.Register("git+https", &gitSource{})
+	r.Register("inline", &inlineSource{})
+	return r
+}
+
+// Register adds or replaces the Source used for scheme.
+func (r *SourceResolver) Register(scheme string, source Source) {
+	r.sources[scheme] = source
+}
+
+// LoadFiles resolves every spec in files and writes the result to dir/name,
+// bounding concurrency to r.concurrency and returning an aggregated error
+// covering every file that failed rather than stopping at (or swallowing)
+// the first one.
+func (r *SourceResolver) LoadFiles(ctx context.Context, dir string, files map[string][]byte) error {
+	sem := make(chan struct{}, r.concurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+
+	for name, content := range files {
+		wg.Add(1)
+		go func(name string, content []byte) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			data, err := r.resolve(ctx, string(content))
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				mu.Unlock()
+				return
+			}
+
+			log.WithField("file", name).Info("Writing resolved content to tmp dir")
+			if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				mu.Unlock()
+			}
+		}(name, content)
+	}
+
+	wg.Wait()
+	if len(errs) > 0 {
+		return sourceErrors(errs)
+	}
+	return nil
+}
+
+// resolve fetches spec's content, retrying retryable (5xx) failures with
+// exponential backoff and verifying any "!sha256:" checksum suffix.
+func (r *SourceResolver) resolve(ctx context.Context, spec string) ([]byte, error) {
+	scheme := schemeOf(spec)
+	if scheme == "" {
+		// schemeOf only knows the built-in schemes; also match any scheme
+		// added with Register.
+		for s := range r.sources {
+			if strings.HasPrefix(spec, s+"://") {
+				scheme = s
+				break
+			}
+		}
+	}
+	source, ok := r.sources[scheme]
+	if !ok {
+		// Not a spec we recognize a scheme for - treat as literal bytes,
+		// same as LoadFiles always has for non-URL content. The checksum
+		// suffix convention only applies to specs with a recognized
+		// scheme, so literal content isn't at risk of being truncated by
+		// an incidental "!sha256:" substring.
+		return []byte(spec), nil
+	}
+
+	spec, checksum := splitChecksum(spec)
+
+	data, err := fetchWithRetry(ctx, func() ([]byte, error) { return source.Fetch(ctx, spec) })
+	if err != nil {
+		return nil, err
+	}
+
+	if checksum != "" {
+		if err := verifyChecksum(data, checksum); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// schemeOf returns the built-in scheme key a spec matches, or "" if none.
+// Schemes added with Register are matched by resolve, not here.
+func schemeOf(spec string) string {
+	if strings.HasPrefix(spec, "inline:") {
+		return "inline"
+	}
+	for _, scheme := range []string{"git+https", "https", "http", "file", "s3"} {
+		if strings.HasPrefix(spec, scheme+"://") {
+			return scheme
+		}
+	}
+	return ""
+}
+
+// splitChecksum splits a trailing "!sha256:<hex>" off spec, if present.
+func splitChecksum(spec string) (rest, checksum string) {
+	idx := strings.LastIndex(spec, "!sha256:")
+	if idx < 0 {
+		return spec, ""
+	}
+	return spec[:idx], spec[idx+len("!sha256:"):]
+}
+
+// verifyChecksum reports an error if data's sha256 doesn't match want (hex).
+func verifyChecksum(data []byte, want string) error {
+	sum := sha256.Sum256(data)
+	got := hex.EncodeToString(sum[:])
+	if got != want {
+		return fmt.Errorf("checksum mismatch: expected sha256:%s, got sha256:%s", want, got)
+	}
+	return nil
+}
+
+// retryableError marks an error from a Source as worth retrying with backoff.
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// fetchWithRetry calls fn, retrying with exponential backoff while it
+// returns a *retryableError, up to 5 attempts or until ctx is cancelled.
+func fetchWithRetry(ctx context.Context, fn func() ([]byte, error)) ([]byte, error) {
+	const maxAttempts = 5
+	backoff := 100 * time.Millisecond
+
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		data, err := fn()
+		if err == nil {
+			return data, nil
+		}
+		lastErr = err
+		if _, retryable := err.(*retryableError); !retryable {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return nil, lastErr
+}
+
+// sourceErrors aggregates multiple per-file failures into one error.
+type sourceErrors []error
+
+func (e sourceErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d file(s) failed to load: %s", len(e), strings.Join(messages, "; "))
+}
+
+// httpSource fetches http(s):// specs, applying per-host basic auth
+// configured under viper's "sources.http_auth.<host>.username/password"
+// rather than hardcoding credentials for specific hosts.
+type httpSource struct{}
+
+func (h *httpSource) Fetch(ctx context.Context, spec string) ([]byte, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if username, password, ok := httpCredentialsFor(u.Hostname()); ok {
+		request.SetBasicAuth(username, password)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 500 {
+		return nil, &retryableError{fmt.Errorf("GET %s: %s", u, response.Status)}
+	}
+	if response.StatusCode >= 400 {
+		return nil, fmt.Errorf("GET %s: %s", u, response.Status)
+	}
+	return body, nil
+}
+
+// httpCredentialsFor looks up basic-auth credentials for host under
+// "sources.http_auth.<host>.username"/".password".
+func httpCredentialsFor(host string) (username, password string, ok bool) {
+	key := "sources.http_auth." + host
+	username = viper.GetString(key + ".username")
+	password = viper.GetString(key + ".password")
+	return username, password, username != "" || password != ""
+}
+
+// fileSource fetches file:// specs off the local filesystem.
+type fileSource struct{}
+
+func (f *fileSource) Fetch(ctx context.Context, spec string) ([]byte, error) {
+	return ioutil.ReadFile(strings.TrimPrefix(spec, "file://"))
+}
+
+// inlineSource strips the "inline:" prefix and returns the rest verbatim.
+type inlineSource struct{}
+
+func (s *inlineSource) Fetch(ctx context.Context, spec string) ([]byte, error) {
+	return []byte(strings.TrimPrefix(spec, "inline:")), nil
+}
+
+// s3Source fetches s3://<bucket>/<key> specs.
+type s3Source struct{}
+
+func (s *s3Source) Fetch(ctx context.Context, spec string) ([]byte, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	bucket := u.Host
+	key := strings.TrimPrefix(u.Path, "/")
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := s3.New(sess).GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return ioutil.ReadAll(out.Body)
+}
+
+// gitSource fetches git+https://host/org/repo.git#ref/path/to/file specs by
+// shallow-cloning the repo at ref into a scratch dir and reading path out of it.
+type gitSource struct{}
+
+func (g *gitSource) Fetch(ctx context.Context, spec string) ([]byte, error) {
+	withoutScheme := strings.TrimPrefix(spec, "git+")
+	u, err := url.Parse(withoutScheme)
+	if err != nil {
+		return nil, err
+	}
+	ref, path := splitRefAndPath(u.Fragment)
+	if ref == "" || path == "" {
+		return nil, fmt.Errorf("git spec %q must have a #<ref>/<path> fragment", spec)
+	}
+	// ref is attacker-controlled (it comes straight from the spec's
+	// fragment) and gets passed as an argv token to git. A ref starting
+	// with "-" would be parsed as an option rather than a branch name -
+	// e.g. "--upload-pack=..." - letting a crafted spec run arbitrary
+	// commands on the herder host. Reject that outright; "--" alone
+	// still wouldn't be enough since --branch takes a following argument.
+	if strings.HasPrefix(ref, "-") || strings.HasPrefix(path, "-") {
+		return nil, fmt.Errorf("git spec %q has an option-like ref or path", spec)
+	}
+	u.Fragment = ""
+
+	tmpdir, err := ioutil.TempDir("", "herder-git-source-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	cmd := exec.CommandContext(ctx, "git", "clone", "--depth", "1", "--branch", ref, "--", u.String(), tmpdir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("git clone %s: %v: %s", u, err, out)
+	}
+
+	return ioutil.ReadFile(filepath.Join(tmpdir, path))
+}
+
+// splitRefAndPath splits a git spec's "<ref>/<path>" fragment in two.
+func splitRefAndPath(fragment string) (ref, path string) {
+	parts := strings.SplitN(fragment, "/", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
+
+var (
+	defaultSourceResolverOnce sync.Once
+	defaultSourceResolverInst *SourceResolver
+)
+
+func defaultSourceResolver() *SourceResolver {
+	defaultSourceResolverOnce.Do(func() {
+		defaultSourceResolverInst = NewSourceResolver()
+	})
+	return defaultSourceResolverInst
+}
+
+// LoadFiles will load the given files into the dir for container usage, per
+// content-source spec. Specs are resolved against the default
+// SourceResolver: URLs, file/git/s3 references and raw bytes passed straight
+// through (the inline: shortcut) are all supported - see SourceResolver.
+func LoadFiles(dir string, files map[string][]byte) error {
+	return LoadFilesWithContext(context.Background(), dir, files)
+}
+
+// LoadFilesWithContext is LoadFiles with a context, so fetches can be
+// cancelled (e.g. alongside RunLambda's ctx).
+func LoadFilesWithContext(ctx context.Context, dir string, files map[string][]byte) error {
+	return defaultSourceResolver().LoadFiles(ctx, dir, files)
+}
@@ -0,0 +1,137 @@
+package container
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestSchemeOf(t *testing.T) {
+	cases := map[string]string{
+		"https://example.com/f":         "https",
+		"http://example.com/f":          "http",
+		"file:///tmp/f":                 "file",
+		"s3://bucket/key":               "s3",
+		"git+https://host/repo.git#a/b": "git+https",
+		"inline:hello":                  "inline",
+		"just some raw bytes":           "",
+	}
+	for spec, want := range cases {
+		if got := schemeOf(spec); got != want {
+			t.Errorf("schemeOf(%q) = %q, want %q", spec, got, want)
+		}
+	}
+}
+
+func TestSplitChecksum(t *testing.T) {
+	rest, checksum := splitChecksum("https://example.com/f!sha256:abc123")
+	if rest != "https://example.com/f" || checksum != "abc123" {
+		t.Errorf("splitChecksum = (%q, %q), want (%q, %q)", rest, checksum, "https://example.com/f", "abc123")
+	}
+
+	rest, checksum = splitChecksum("https://example.com/f")
+	if rest != "https://example.com/f" || checksum != "" {
+		t.Errorf("splitChecksum without a suffix = (%q, %q), want unchanged spec and empty checksum", rest, checksum)
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	data := []byte("hello world")
+	sum := sha256.Sum256(data)
+	want := hex.EncodeToString(sum[:])
+
+	if err := verifyChecksum(data, want); err != nil {
+		t.Errorf("verifyChecksum with matching sum: %v", err)
+	}
+	if err := verifyChecksum(data, "0000"); err == nil {
+		t.Error("verifyChecksum with mismatched sum returned nil error")
+	}
+}
+
+// TestResolveLiteralFallbackIgnoresChecksumSyntax guards against the bug
+// where a literal spec (no registered scheme) containing "!sha256:" was
+// truncated and the remainder treated as a checksum, instead of being
+// passed through verbatim like LoadFiles has always done for raw content.
+func TestResolveLiteralFallbackIgnoresChecksumSyntax(t *testing.T) {
+	r := NewSourceResolver()
+	spec := "some inline content with a literal !sha256:notachecksum substring"
+
+	data, err := r.resolve(context.Background(), spec)
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if string(data) != spec {
+		t.Errorf("resolve(%q) = %q, want it unchanged", spec, data)
+	}
+}
+
+type fakeSource struct {
+	attempts int
+	fail     int
+	err      error
+	result   []byte
+}
+
+func (f *fakeSource) Fetch(ctx context.Context, spec string) ([]byte, error) {
+	f.attempts++
+	if f.attempts <= f.fail {
+		return nil, f.err
+	}
+	return f.result, nil
+}
+
+// TestResolveRetriesRetryableErrors covers fetchWithRetry via resolve: a
+// Source that fails with a retryable error a couple of times before
+// succeeding should have its eventual result returned, not the error.
+func TestResolveRetriesRetryableErrors(t *testing.T) {
+	src := &fakeSource{fail: 2, err: &retryableError{errors.New("503")}, result: []byte("payload")}
+	r := NewSourceResolver()
+	r.Register("fake", src)
+
+	data, err := r.resolve(context.Background(), "fake://thing")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if string(data) != "payload" {
+		t.Errorf("resolve = %q, want %q", data, "payload")
+	}
+	if src.attempts != 3 {
+		t.Errorf("attempts = %d, want 3 (2 failures + 1 success)", src.attempts)
+	}
+}
+
+// TestResolveDoesNotRetryNonRetryableErrors ensures a plain error from a
+// Source is surfaced immediately instead of being retried with backoff.
+func TestResolveDoesNotRetryNonRetryableErrors(t *testing.T) {
+	src := &fakeSource{fail: 1, err: errors.New("not found")}
+	r := NewSourceResolver()
+	r.Register("fake", src)
+
+	if _, err := r.resolve(context.Background(), "fake://thing"); err == nil {
+		t.Fatal("resolve with a non-retryable Source error returned nil")
+	}
+	if src.attempts != 1 {
+		t.Errorf("attempts = %d, want 1 (no retry for a non-retryable error)", src.attempts)
+	}
+}
+
+// TestResolveVerifiesChecksum covers the scheme+checksum path together: a
+// registered scheme's content must pass checksum verification to be
+// returned, and a mismatch must be surfaced as an error.
+func TestResolveVerifiesChecksum(t *testing.T) {
+	payload := []byte("payload")
+	sum := sha256.Sum256(payload)
+	want := hex.EncodeToString(sum[:])
+
+	r := NewSourceResolver()
+	r.Register("fake", &fakeSource{result: payload})
+
+	if _, err := r.resolve(context.Background(), "fake://thing!sha256:"+want); err != nil {
+		t.Errorf("resolve with a matching checksum: %v", err)
+	}
+	if _, err := r.resolve(context.Background(), "fake://thing!sha256:0000"); err == nil {
+		t.Error("resolve with a mismatched checksum returned nil error")
+	}
+}
@@ -1,8 +1,10 @@
 package metering
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
-	"strconv"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/boltdb/bolt"
@@ -18,20 +20,63 @@ func init() {
 	db = meterdb
 }
 
-// NewMeter returns a new Meter for the given token
+// Quota describes a token bucket: up to Capacity tokens can be reserved
+// before a caller has to wait, refilling at RefillPerSecond tokens/second up
+// to Capacity again. RefillPerSecond of 0 means the bucket never refills -
+// once it's empty, Reserve fails outright instead of blocking forever.
+type Quota struct {
+	Capacity        int64
+	RefillPerSecond int64
+}
+
+// NewMeter returns a new Meter for the given token, with its usage budget
+// and its (separate) admission bucket both initialized to quota.Capacity.
 // Database is structured as follows:
 // Each token has a Bucket with the token id as name.
-// Each Bucket has the following properties:
+// Each Bucket has the following properties, all stored as fixed-width
+// big-endian uint64s:
+// * MillisecondsRemaining (the usage budget Record debits; what OutOfResources checks)
 // * MillisecondsUsed
-// * MillisecondsRemaining
-// * TODO figure out more stats to track
-func NewMeter(id string, remainingMs int) (*Meter, error) {
+// * MemoryByteSecondsUsed
+// * CPUNanoSecondsUsed
+// * AdmissionTokens (the concurrency-admission token bucket's current balance, debited by Reserve)
+// * Capacity
+// * RefillPerSecond
+// * LastRefillUnixNano
+//
+// MillisecondsRemaining/MillisecondsUsed and AdmissionTokens are deliberately
+// distinct counters: the former tracks how much runtime the token has left,
+// the latter just throttles how fast new reservations are admitted. Letting
+// Reserve refill the usage budget over wall-clock time would let a token's
+// real usage leak back in every time a new container is launched on it.
+func NewMeter(id string, quota Quota) (*Meter, error) {
 	err := db.Update(func(tx *bolt.Tx) error {
-		if b, err := tx.CreateBucket([]byte(id)); err == nil {
-			b.Put([]byte("MillisecondsRemaining"), []byte(strconv.Itoa(remainingMs)))
-			b.Put([]byte("MillisecondsUsed"), []byte("0"))
+		b, err := tx.CreateBucket([]byte(id))
+		if err != nil {
+			return err
 		}
-		return nil
+		if err := putUint64(b, "MillisecondsRemaining", uint64(quota.Capacity)); err != nil {
+			return err
+		}
+		if err := putUint64(b, "MillisecondsUsed", 0); err != nil {
+			return err
+		}
+		if err := putUint64(b, "MemoryByteSecondsUsed", 0); err != nil {
+			return err
+		}
+		if err := putUint64(b, "CPUNanoSecondsUsed", 0); err != nil {
+			return err
+		}
+		if err := putUint64(b, "AdmissionTokens", uint64(quota.Capacity)); err != nil {
+			return err
+		}
+		if err := putUint64(b, "Capacity", uint64(quota.Capacity)); err != nil {
+			return err
+		}
+		if err := putUint64(b, "RefillPerSecond", uint64(quota.RefillPerSecond)); err != nil {
+			return err
+		}
+		return putUint64(b, "LastRefillUnixNano", uint64(time.Now().UnixNano()))
 	})
 	if err != nil {
 		return nil, err
@@ -45,81 +90,243 @@ type Meter struct {
 	db *bolt.DB
 }
 
+// ResourceUsage describes a slice of resource consumption to be recorded
+// against a token, as sampled off a running container.
+type ResourceUsage struct {
+	Milliseconds      int
+	MemoryByteSeconds int64
+	CPUNanoSeconds    int64
+}
+
 // Status contains information about the current status of the resources of a token
 type Status struct {
 	MillisecondsRemaining int
+	MemoryByteSecondsUsed int64
+	CPUNanoSecondsUsed    int64
 }
 
 func (m *Meter) MillisecondsRemaining() (int, error) {
-	var msr int
+	var msr uint64
 	err := db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(m.ID))
-		if b != nil {
-			res := b.Get([]byte("MillisecondsRemaining"))
-			if res != nil {
-				ms, err := strconv.Atoi(string(res))
-				if err != nil {
-					return err
-				}
-				msr = ms
-			}
+		if b == nil {
+			return fmt.Errorf("Could not find bucket for given id")
 		}
-		return fmt.Errorf("Could not get time remaining")
+		var err error
+		msr, err = getUint64(b, "MillisecondsRemaining")
+		return err
 	})
 	if err != nil {
 		return 0, err
 	}
-	return msr, nil
+	return int(msr), nil
+}
+
+// OutOfResources reports whether the token has exhausted its milliseconds-
+// of-runtime budget. MemoryByteSecondsUsed and CPUNanoSecondsUsed are
+// recorded by Record but have no quota of their own yet, so they can never
+// trip this check.
+func (m *Meter) OutOfResources() (bool, error) {
+	msr, err := m.MillisecondsRemaining()
+	if err != nil {
+		return false, err
+	}
+	return msr <= 0, nil
 }
 
-func (m *Meter) RecordMilliseconds(ms int) error {
+// Record debits the given usage from the token, updating both the used and
+// (where applicable) remaining counters in a single transaction.
+func (m *Meter) Record(usage ResourceUsage) error {
 	return db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(m.ID))
-		if b != nil {
-			var remaining, used int
-			// Get remaining
-			res := b.Get([]byte("MillisecondsRemaining"))
-			if res != nil {
-				ms, err := strconv.Atoi(string(res))
-				if err != nil {
-					return err
-				}
-				remaining = ms
-			}
-			// Do not record if >= 0
-			if remaining <= 0 {
-				return fmt.Errorf("Could not record time - no time left")
-			}
+		if b == nil {
+			return fmt.Errorf("Could not update for given id")
+		}
+
+		remaining, err := getUint64(b, "MillisecondsRemaining")
+		if err != nil {
+			return err
+		}
+		// Do not record if no time is left
+		if remaining == 0 {
+			return fmt.Errorf("Could not record usage - no time left")
+		}
+
+		used, err := getUint64(b, "MillisecondsUsed")
+		if err != nil {
+			return err
+		}
+		memUsed, err := getUint64(b, "MemoryByteSecondsUsed")
+		if err != nil {
+			return err
+		}
+		cpuUsed, err := getUint64(b, "CPUNanoSecondsUsed")
+		if err != nil {
+			return err
+		}
+
+		spent := uint64(usage.Milliseconds)
+		if spent > remaining {
+			spent = remaining
+		}
+
+		if err := putUint64(b, "MillisecondsRemaining", remaining-spent); err != nil {
+			return err
+		}
+		if err := putUint64(b, "MillisecondsUsed", used+spent); err != nil {
+			return err
+		}
+		if err := putUint64(b, "MemoryByteSecondsUsed", memUsed+uint64(usage.MemoryByteSeconds)); err != nil {
+			return err
+		}
+		if err := putUint64(b, "CPUNanoSecondsUsed", cpuUsed+uint64(usage.CPUNanoSeconds)); err != nil {
+			return err
+		}
 
-			// Get used
-			res = b.Get([]byte("MillisecondsUsed"))
-			if res != nil {
-				ms, err := strconv.Atoi(string(res))
-				if err != nil {
+		log.WithField("remaining", remaining-spent).Info("Recorded some usage")
+		return nil
+	})
+}
+
+// Reserve blocks until cost admission tokens are available in the token's
+// bucket, atomically debiting them from AdmissionTokens (never from the
+// usage-tracked MillisecondsRemaining/MillisecondsUsed pair Record maintains)
+// in a single Bolt transaction, so that concurrent reservations against the
+// same token queue fairly instead of racing on a read-modify-write of the
+// same counter. This only throttles how fast new containers are admitted;
+// it does not account for or protect the token's actual usage budget, which
+// Record debits separately as the container runs. It returns early with
+// ctx's error if ctx is cancelled before enough tokens refill, or
+// immediately if the bucket has no refill and can never satisfy cost.
+func (m *Meter) Reserve(ctx context.Context, cost int) error {
+	for {
+		reserved, retryAfter, err := m.tryReserve(cost)
+		if err != nil {
+			return err
+		}
+		if reserved {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryAfter):
+		}
+	}
+}
+
+// tryReserve attempts a single reservation, first refilling the admission
+// bucket for elapsed time. If the balance is insufficient it reports how
+// long the caller should wait before retrying.
+func (m *Meter) tryReserve(cost int) (reserved bool, retryAfter time.Duration, err error) {
+	err = m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(m.ID))
+		if b == nil {
+			return fmt.Errorf("Could not reserve for given id")
+		}
+
+		capacity, err := getUint64(b, "Capacity")
+		if err != nil {
+			return err
+		}
+		refillPerSecond, err := getUint64(b, "RefillPerSecond")
+		if err != nil {
+			return err
+		}
+		lastRefillNano, err := getUint64(b, "LastRefillUnixNano")
+		if err != nil {
+			return err
+		}
+		available, err := getUint64(b, "AdmissionTokens")
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if refillPerSecond > 0 {
+			lastRefill := time.Unix(0, int64(lastRefillNano))
+			elapsed := now.Sub(lastRefill)
+			var refill uint64
+			if elapsed > 0 {
+				refill = uint64(elapsed.Seconds() * float64(refillPerSecond))
+			}
+			// Advance LastRefillUnixNano only by the time the whole tokens
+			// added account for, so elapsed time worth less than one token
+			// carries over to the next call instead of being discarded.
+			if refill > 0 {
+				if available+refill >= capacity {
+					available = capacity
+					lastRefill = now
+				} else {
+					available += refill
+					lastRefill = lastRefill.Add(time.Duration(float64(refill) / float64(refillPerSecond) * float64(time.Second)))
+				}
+				if err := putUint64(b, "LastRefillUnixNano", uint64(lastRefill.UnixNano())); err != nil {
 					return err
 				}
-				used = ms
 			}
-			// Update
-			err := b.Put([]byte("MillisecondsRemaining"), []byte(strconv.Itoa(remaining-ms)))
-			if err != nil {
-				return err
-			}
-			err = b.Put([]byte("MillisecondsUsed"), []byte(strconv.Itoa(used+ms)))
-			if err != nil {
-				return err
+		}
+
+		if available < uint64(cost) {
+			if refillPerSecond == 0 {
+				return fmt.Errorf("Token %s cannot satisfy reservation of %d - bucket does not refill", m.ID, cost)
 			}
-			log.WithField("remaining", remaining-ms).Info("Recorded some time")
-			return nil
+			deficit := uint64(cost) - available
+			retryAfter = time.Duration(float64(deficit) / float64(refillPerSecond) * float64(time.Second))
+			return putUint64(b, "AdmissionTokens", available)
 		}
-		return fmt.Errorf("Could not update for given id")
+
+		reserved = true
+		return putUint64(b, "AdmissionTokens", available-uint64(cost))
 	})
+	return reserved, retryAfter, err
 }
 
 func (m *Meter) Inspect() (*Status, error) {
-	msr, err := m.MillisecondsRemaining()
+	var status Status
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(m.ID))
+		if b == nil {
+			return fmt.Errorf("Could not find bucket for given id")
+		}
+		msr, err := getUint64(b, "MillisecondsRemaining")
+		if err != nil {
+			return err
+		}
+		mem, err := getUint64(b, "MemoryByteSecondsUsed")
+		if err != nil {
+			return err
+		}
+		cpu, err := getUint64(b, "CPUNanoSecondsUsed")
+		if err != nil {
+			return err
+		}
+		status = Status{MillisecondsRemaining: int(msr), MemoryByteSecondsUsed: int64(mem), CPUNanoSecondsUsed: int64(cpu)}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	return &Status{MillisecondsRemaining: msr}, nil
+	return &status, nil
+}
+
+// getUint64 reads a fixed-width big-endian uint64 from the given key,
+// returning 0 if unset.
+func getUint64(b *bolt.Bucket, key string) (uint64, error) {
+	res := b.Get([]byte(key))
+	if res == nil {
+		return 0, nil
+	}
+	if len(res) != 8 {
+		return 0, fmt.Errorf("Corrupt value for key %s: expected 8 bytes, got %d", key, len(res))
+	}
+	return binary.BigEndian.Uint64(res), nil
+}
+
+// putUint64 writes a fixed-width big-endian uint64 to the given key.
+func putUint64(b *bolt.Bucket, key string, v uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, v)
+	return b.Put([]byte(key), buf)
 }
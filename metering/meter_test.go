@@ -0,0 +1,83 @@
+package metering
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// newTestMeter returns a Meter backed by a fresh bucket, scoped to the
+// calling test and cleaned up afterwards.
+func newTestMeter(t *testing.T, quota Quota) *Meter {
+	t.Helper()
+	id := "test-" + t.Name()
+	db.Update(func(tx *bolt.Tx) error { return tx.DeleteBucket([]byte(id)) })
+
+	m, err := NewMeter(id, quota)
+	if err != nil {
+		t.Fatalf("NewMeter: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Update(func(tx *bolt.Tx) error { return tx.DeleteBucket([]byte(id)) })
+	})
+	return m
+}
+
+// TestReserveDebitsAdmissionNotUsage guards against the regression where
+// Reserve and Record shared (and silently refilled) the same counter.
+func TestReserveDebitsAdmissionNotUsage(t *testing.T) {
+	m := newTestMeter(t, Quota{Capacity: 10, RefillPerSecond: 0})
+
+	if err := m.Record(ResourceUsage{Milliseconds: 4}); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	if remaining, err := m.MillisecondsRemaining(); err != nil || remaining != 6 {
+		t.Fatalf("MillisecondsRemaining = %d, %v, want 6, nil", remaining, err)
+	}
+
+	if err := m.Reserve(context.Background(), 3); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if remaining, err := m.MillisecondsRemaining(); err != nil || remaining != 6 {
+		t.Fatalf("MillisecondsRemaining after Reserve = %d, %v, want unchanged 6, nil", remaining, err)
+	}
+}
+
+// TestTryReserveExhaustsThenReportsRetryAfter covers the deficit/backoff math:
+// once the bucket is drained, a further reservation must report how long to
+// wait rather than granting it early.
+func TestTryReserveExhaustsThenReportsRetryAfter(t *testing.T) {
+	m := newTestMeter(t, Quota{Capacity: 2, RefillPerSecond: 2})
+
+	reserved, _, err := m.tryReserve(2)
+	if err != nil || !reserved {
+		t.Fatalf("tryReserve(2) = reserved=%v err=%v, want reserved=true", reserved, err)
+	}
+
+	reserved, retryAfter, err := m.tryReserve(1)
+	if err != nil {
+		t.Fatalf("tryReserve(1): %v", err)
+	}
+	if reserved {
+		t.Fatalf("tryReserve(1) succeeded against an exhausted bucket")
+	}
+	if retryAfter <= 0 || retryAfter > time.Second {
+		t.Fatalf("retryAfter = %v, want in (0, 1s] for a 1-token deficit at 2/s refill", retryAfter)
+	}
+}
+
+// TestTryReserveNoRefillFailsOutright covers RefillPerSecond == 0: an
+// exhausted bucket that never refills must fail immediately rather than
+// report a retryAfter that would never actually produce more tokens.
+func TestTryReserveNoRefillFailsOutright(t *testing.T) {
+	m := newTestMeter(t, Quota{Capacity: 1, RefillPerSecond: 0})
+
+	if reserved, _, err := m.tryReserve(1); err != nil || !reserved {
+		t.Fatalf("tryReserve(1) = reserved=%v err=%v, want reserved=true, nil", reserved, err)
+	}
+	if _, _, err := m.tryReserve(1); err == nil {
+		t.Fatal("tryReserve(1) on an exhausted non-refilling bucket should fail outright")
+	}
+}